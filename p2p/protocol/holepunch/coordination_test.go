@@ -3,6 +3,7 @@ package holepunch_test
 import (
 	"context"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,7 +38,7 @@ func TestDirectDialWorks(t *testing.T) {
 	h2.RemoveStreamHandler(holepunch.Protocol)
 	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.ConnectedAddrTTL)
 
-	require.NoError(t, h1ps.HolePunch(h2.ID()))
+	require.NoError(t, h1ps.HolePunch(ctx, h2.ID()))
 
 	cs := h1.Network().ConnsToPeer(h2.ID())
 	require.Len(t, cs, 1)
@@ -50,9 +51,9 @@ func TestFailuresOnInitiator(t *testing.T) {
 	ctx := context.Background()
 
 	tcs := map[string]struct {
-		rhandler         func(s network.Stream)
-		errMsg           string
-		holePunchTimeout time.Duration
+		rhandler    func(s network.Stream)
+		errMsg      string
+		callTimeout time.Duration
 	}{
 		"responder does NOT send a CONNECT message": {
 			rhandler: func(s network.Stream) {
@@ -63,10 +64,10 @@ func TestFailuresOnInitiator(t *testing.T) {
 			},
 			errMsg: "expected HolePunch_CONNECT message",
 		},
-		"responder does NOT support protocol": {
-			rhandler: nil,
-			errMsg:   "protocol not supported",
-		},
+		// a responder that doesn't speak the protocol at all is no longer
+		// exercised here: NewStream's implicit dial still succeeds against
+		// it, so initiate now correctly treats that as an opportunistic
+		// direct connection instead of an error (see TestDirectDialWorks).
 		"unable to READ CONNECT message from responder": {
 			rhandler: func(s network.Stream) {
 				s.Reset()
@@ -74,7 +75,7 @@ func TestFailuresOnInitiator(t *testing.T) {
 			errMsg: "failed to read HolePunch_CONNECT message",
 		},
 		"responder does NOT reply within hole punch deadline": {
-			holePunchTimeout: 10 * time.Millisecond,
+			callTimeout: 10 * time.Millisecond,
 			rhandler: func(s network.Stream) {
 				for {
 
@@ -86,25 +87,24 @@ func TestFailuresOnInitiator(t *testing.T) {
 
 	for name, tc := range tcs {
 		t.Run(name, func(t *testing.T) {
-			if tc.holePunchTimeout != 0 {
-				cpy := holepunch.HolePunchTimeout
-				holepunch.HolePunchTimeout = tc.holePunchTimeout
-				defer func() {
-					holepunch.HolePunchTimeout = cpy
-				}()
-			}
-
 			h1, h1ps := mkHostWithHolePunchSvc(t, ctx)
 			h2, _ := mkHostWithHolePunchSvc(t, ctx)
 
-			if tc.rhandler != nil {
-				h2.SetStreamHandler(holepunch.Protocol, tc.rhandler)
-			} else {
-				h2.RemoveStreamHandler(holepunch.Protocol)
+			h2.SetStreamHandler(holepunch.Protocol, tc.rhandler)
+
+			// share addresses without connecting: HolePunch short-circuits on
+			// an existing direct connection, and these cases need the real
+			// dial to happen from inside it.
+			h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.ConnectedAddrTTL)
+
+			callCtx := ctx
+			if tc.callTimeout != 0 {
+				var cancel context.CancelFunc
+				callCtx, cancel = context.WithTimeout(ctx, tc.callTimeout)
+				defer cancel()
 			}
 
-			connect(t, ctx, h1, h2)
-			err := h1ps.HolePunch(h2.ID())
+			err := h1ps.HolePunch(callCtx, h2.ID())
 			require.Error(t, err)
 			require.Contains(t, err.Error(), tc.errMsg)
 		})
@@ -116,9 +116,9 @@ func TestFailuresOnResponder(t *testing.T) {
 	ctx := context.Background()
 
 	tcs := map[string]struct {
-		initiator        func(s network.Stream)
-		errMsg           string
-		holePunchTimeout time.Duration
+		initiator      func(s network.Stream)
+		errMsg         string
+		handlerTimeout time.Duration
 	}{
 		"initiator does NOT send a CONNECT message": {
 			initiator: func(s network.Stream) {
@@ -146,7 +146,7 @@ func TestFailuresOnResponder(t *testing.T) {
 		},
 
 		"initiator does NOT reply within hole punch deadline": {
-			holePunchTimeout: 10 * time.Millisecond,
+			handlerTimeout: 10 * time.Millisecond,
 			initiator: func(s network.Stream) {
 				w := protoio.NewDelimitedWriter(s)
 				msg := new(holepunch_pb.HolePunch)
@@ -163,16 +163,18 @@ func TestFailuresOnResponder(t *testing.T) {
 
 	for name, tc := range tcs {
 		t.Run(name, func(t *testing.T) {
-			if tc.holePunchTimeout != 0 {
-				cpy := holepunch.HolePunchTimeout
-				holepunch.HolePunchTimeout = tc.holePunchTimeout
-				defer func() {
-					holepunch.HolePunchTimeout = cpy
-				}()
+			// the service-level context bounds the responder's own per-stream
+			// deadline, so a short-lived one here stands in for the old
+			// mutable global timeout.
+			svcCtx := ctx
+			if tc.handlerTimeout != 0 {
+				var cancel context.CancelFunc
+				svcCtx, cancel = context.WithTimeout(ctx, tc.handlerTimeout)
+				defer cancel()
 			}
 
 			h1, _ := mkHostWithHolePunchSvc(t, ctx)
-			h2, h2ps := mkHostWithHolePunchSvc(t, ctx)
+			h2, h2ps := mkHostWithHolePunchSvc(t, svcCtx)
 			connect(t, ctx, h1, h2)
 
 			s, err := h1.NewStream(ctx, h2.ID(), holepunch.Protocol)
@@ -202,6 +204,13 @@ func TestObservedAddressesAreExchanged(t *testing.T) {
 	h1, h1ps := mkHostWithHolePunchSvc(t, ctx)
 	h2, _ := mkHostWithHolePunchSvc(t, ctx)
 
+	// only share addresses, don't connect: HolePunch short-circuits on an
+	// existing direct connection, and this test needs the real CONNECT/SYNC
+	// exchange (and the dial-back that follows it) to run so the observed
+	// addresses actually get carried over.
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.ConnectedAddrTTL)
+	h2.Peerstore().AddAddrs(h1.ID(), h1.Addrs(), peerstore.ConnectedAddrTTL)
+
 	// modify identify handlers to send our fake observed addresses
 	h1.SetStreamHandler(identify.ID, func(s network.Stream) {
 		writer := protoio.NewDelimitedWriter(s)
@@ -219,10 +228,11 @@ func TestObservedAddressesAreExchanged(t *testing.T) {
 		s.Close()
 	})
 
-	connect(t, ctx, h1, h2)
-
-	// hole punch so both peers exchange each other's observed addresses and save to peerstore
-	require.NoError(t, h1ps.HolePunch(h2.ID()))
+	// hole punch so both peers exchange each other's observed addresses and save to peerstore;
+	// the CONNECT/SYNC stream itself establishes a direct connection, so the
+	// dial-back to the (fake, undialable) observed addresses below just
+	// confirms that existing connection rather than dialing a new one.
+	require.NoError(t, h1ps.HolePunch(ctx, h2.ID()))
 
 	require.Eventually(t, func() bool {
 		h2Addrs := h1.Peerstore().Addrs(h2.ID())
@@ -249,11 +259,228 @@ func TestObservedAddressesAreExchanged(t *testing.T) {
 }
 
 func TestHolePunchingAttemptsAreDeduplicated(t *testing.T) {
+	ctx := context.Background()
 
+	h1, h1ps := mkHostWithHolePunchSvc(t, ctx)
+	h2, _ := mkHostWithHolePunchSvc(t, ctx)
+	h2.RemoveStreamHandler(holepunch.Protocol)
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.ConnectedAddrTTL)
+
+	// fire off two concurrent hole punches to the same peer; the second one
+	// should not open its own stream, but instead wait on the first.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			errs[i] = h1ps.HolePunch(ctx, h2.ID())
+		}()
+	}
+	wg.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	cs := h1.Network().ConnsToPeer(h2.ID())
+	require.Len(t, cs, 1)
 }
 
 func TestNoHolePunchingIfDirectConnAlreadyExists(t *testing.T) {
+	ctx := context.Background()
+
+	h1, h1ps := mkHostWithHolePunchSvc(t, ctx)
+	h2, _ := mkHostWithHolePunchSvc(t, ctx)
+
+	connect(t, ctx, h1, h2)
+
+	// HolePunch must short-circuit on the existing direct connection
+	// without ever opening a DCUtR stream; fail the test if it does.
+	h2.SetStreamHandler(holepunch.Protocol, func(s network.Stream) {
+		s.Reset()
+		t.Error("unexpected DCUtR stream: HolePunch should have returned without dialing")
+	})
+
+	require.NoError(t, h1ps.HolePunch(ctx, h2.ID()))
+}
+
+func TestConcurrentBidirectionalHolePunch(t *testing.T) {
+	ctx := context.Background()
+
+	h1, h1ps := mkHostWithHolePunchSvc(t, ctx)
+	h2, h2ps := mkHostWithHolePunchSvc(t, ctx)
+
+	connect(t, ctx, h1, h2)
+	// tear down the existing connection so both sides have to hole punch
+	// their way back to a direct connection, as if it only existed over a
+	// relay.
+	for _, c := range h1.Network().ConnsToPeer(h2.ID()) {
+		c.Close()
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = h1ps.HolePunch(ctx, h2.ID())
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = h2ps.HolePunch(ctx, h1.ID())
+	}()
+	wg.Wait()
+
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+
+	require.Len(t, h1.Network().ConnsToPeer(h2.ID()), 1)
+	require.Len(t, h2.Network().ConnsToPeer(h1.ID()), 1)
+}
+
+// TestConcurrentResponderStreamsFromSamePeerDontPanic exercises two DCUtR
+// streams arriving from the same remote peer while we have our own
+// outgoing attempt in flight for it. Both carry the same (lowest possible)
+// nonce, so handleNewStream deterministically decides on both that "the
+// remote wins" and takes over the in-flight entry. Before ip.role was read
+// and flipped under hs.mu as a single critical section, both handler
+// goroutines could read the stale initiator role and both call
+// close(ip.abort); the second close panics, and handleNewStreamAsync has
+// no recover(), so that panic used to take down the whole process.
+func TestConcurrentResponderStreamsFromSamePeerDontPanic(t *testing.T) {
+	ctx := context.Background()
+
+	h1, h1ps := mkHostWithHolePunchSvc(t, ctx)
+	h2, _ := mkHostWithHolePunchSvc(t, ctx)
+
+	connect(t, ctx, h1, h2)
+	for _, c := range h1.Network().ConnsToPeer(h2.ID()) {
+		c.Close()
+	}
+
+	// h2 doesn't run its own HolePunchService here: it plays a scripted
+	// remote that races h1's outgoing rendezvous with two concurrent
+	// incoming streams instead of one, to hit the race above.
+	h2.SetStreamHandler(holepunch.Protocol, func(s network.Stream) {
+		s.Reset()
+	})
 
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			rs, err := h2.NewStream(ctx, h1.ID(), holepunch.Protocol)
+			if err != nil {
+				return
+			}
+			defer rs.Close()
+			var nonce uint64 // lowest possible nonce: always wins the race
+			w := protoio.NewDelimitedWriter(rs)
+			w.WriteMsg(&holepunch_pb.HolePunch{
+				Type:  holepunch_pb.HolePunch_CONNECT.Enum(),
+				Nonce: &nonce,
+			})
+		}()
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	h1ps.HolePunch(callCtx, h2.ID())
+
+	wg.Wait()
+}
+
+func TestCloseWaitsForHandlers(t *testing.T) {
+	ctx := context.Background()
+
+	h1, _ := mkHostWithHolePunchSvc(t, ctx)
+	h2, h2ps := mkHostWithHolePunchSvc(t, ctx)
+	connect(t, ctx, h1, h2)
+
+	// an initiator that sends CONNECT but never follows up with SYNC leaves
+	// h2's handler goroutine blocked reading; Close must still return once
+	// it cancels that goroutine, rather than hanging forever.
+	s, err := h1.NewStream(ctx, h2.ID(), holepunch.Protocol)
+	require.NoError(t, err)
+	go func() {
+		w := protoio.NewDelimitedWriter(s)
+		msg := new(holepunch_pb.HolePunch)
+		msg.Type = holepunch_pb.HolePunch_CONNECT.Enum()
+		w.WriteMsg(msg)
+		for {
+		}
+	}()
+
+	closed := make(chan error, 1)
+	go func() { closed <- h2ps.Close() }()
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return within 5s of an in-flight handler hanging")
+	}
+}
+
+// TestCloseUnblocksHandlerParkedOnRendezvousTakeover covers the other way
+// a handler goroutine can be left parked: handleNewStream's "our own
+// outgoing attempt wins" branch waits on ip.done, which only closes once
+// the racing initiate() call returns - and that call is bounded by
+// whatever context its own HolePunch(ctx, rp) caller passed in, not
+// hs.ctx. TestCloseWaitsForHandlers only covers a handler blocked on its
+// own stream read; this covers the parked-on-takeover case, which used to
+// have no way to observe Close()'s cancellation at all.
+func TestCloseUnblocksHandlerParkedOnRendezvousTakeover(t *testing.T) {
+	ctx := context.Background()
+
+	h1, _ := mkHostWithHolePunchSvc(t, ctx)
+	h2, h2ps := mkHostWithHolePunchSvc(t, ctx)
+	connect(t, ctx, h1, h2)
+	for _, c := range h1.Network().ConnsToPeer(h2.ID()) {
+		c.Close()
+	}
+
+	// h1 plays an unresponsive remote for h2's own outgoing rendezvous: it
+	// reads the CONNECT h2 sends but never replies, so the initiate() call
+	// started below - with a context.Background() caller context, standing
+	// in for some other long-lived caller - never completes on its own.
+	ready := make(chan struct{})
+	h1.SetStreamHandler(holepunch.Protocol, func(s network.Stream) {
+		var msg holepunch_pb.HolePunch
+		rd := protoio.NewDelimitedReader(s, network.MessageSizeMax)
+		rd.ReadMsg(&msg)
+		close(ready)
+		select {}
+	})
+
+	go h2ps.HolePunch(context.Background(), h1.ID())
+	<-ready
+
+	// h1 now races h2's own outgoing attempt with its own incoming stream
+	// carrying the highest possible nonce, so h2's handleNewStream always
+	// decides its own outgoing attempt wins and parks this stream on
+	// ip.done, which never closes on its own since h1 never answers it.
+	rs, err := h1.NewStream(ctx, h2.ID(), holepunch.Protocol)
+	require.NoError(t, err)
+	defer rs.Close()
+	nonce := ^uint64(0)
+	w := protoio.NewDelimitedWriter(rs)
+	require.NoError(t, w.WriteMsg(&holepunch_pb.HolePunch{
+		Type:  holepunch_pb.HolePunch_CONNECT.Enum(),
+		Nonce: &nonce,
+	}))
+
+	closed := make(chan error, 1)
+	go func() { closed <- h2ps.Close() }()
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return within 5s of a handler parked on a racing rendezvous takeover")
+	}
 }
 
 func connect(t *testing.T, ctx context.Context, h1, h2 host.Host) network.Conn {
@@ -267,13 +494,13 @@ func connect(t *testing.T, ctx context.Context, h1, h2 host.Host) network.Conn {
 	return cs[0]
 }
 
-func mkHostWithHolePunchSvc(t *testing.T, ctx context.Context) (host.Host, *holepunch.HolePunchService) {
-	h, err := libp2p.New(ctx)
+func mkHostWithHolePunchSvc(t *testing.T, ctx context.Context, opts ...holepunch.Option) (host.Host, *holepunch.HolePunchService) {
+	h, err := libp2p.New(context.Background())
 	require.NoError(t, err)
 	ids, err := identify.NewIDService(h)
 	require.NoError(t, err)
-	hps, err := holepunch.NewHolePunchService(h, ids, true)
+	hps, err := holepunch.NewHolePunchService(ctx, h, ids, true, opts...)
 	require.NoError(t, err)
 
 	return h, hps
-}
\ No newline at end of file
+}
@@ -0,0 +1,662 @@
+// Package holepunch implements the /libp2p/dcutr protocol, which allows two
+// peers that are each behind their own NAT to establish a direct connection
+// with one another, coordinated through a relayed connection. Candidate
+// addresses exchanged over the relay are dialed back in parallel, one
+// Puncher per transport (TCP simultaneous open, QUIC hole punch, ...), and
+// the first one to succeed wins.
+package holepunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch/pb"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-msgio/protoio"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Protocol is the libp2p protocol for the Direct Connection Upgrade through
+// Relay (DCUtR) hole punch exchange.
+const Protocol = "/libp2p/dcutr"
+
+var log = logging.Logger("holepunch")
+
+// defaultHandlerTimeout bounds how long the responder side of a hole punch
+// waits for the initiator, when the service-level context passed to
+// NewHolePunchService doesn't impose an earlier deadline of its own.
+const defaultHandlerTimeout = 5 * time.Second
+
+// errYielded is returned by initiate when a concurrent, lower-nonce
+// rendezvous from the remote peer wins the race and takes over the
+// in-flight punch as a responder. It never escapes HolePunch: the caller
+// waits for that takeover to finish instead and returns its real result.
+var errYielded = errors.New("yielded initiator role to concurrent lower-nonce rendezvous")
+
+// role describes which side of a rendezvous a peer is playing for a given
+// hole punch attempt.
+type role int
+
+const (
+	roleInitiator role = iota
+	roleResponder
+)
+
+// inflightPunch tracks a hole punch that is currently in progress for a
+// given remote peer, so that concurrent callers and concurrent rendezvous
+// attempts from the remote side can be deduplicated against a single
+// coordinated attempt.
+type inflightPunch struct {
+	role  role
+	nonce uint64
+	done  chan struct{}
+	abort chan struct{}
+	err   error
+
+	// finishOnce guards against the punch being finished twice: the
+	// takeover path in handleNewStream and the yielding initiator's own
+	// HolePunch call can both observe a terminal condition for the same
+	// entry (see finish).
+	finishOnce sync.Once
+}
+
+// HolePunchService is run by nodes that are behind a NAT or firewall and
+// speak the /libp2p/dcutr protocol to coordinate a direct connection with a
+// remote peer, relaying the initial signalling exchange over an existing
+// relayed connection.
+type HolePunchService struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	h   host.Host
+	ids *identify.IDService
+
+	// active indicates if this host will initiate hole punches.
+	active bool
+
+	mu            sync.Mutex
+	handlerErrors []error
+	inflight      map[peer.ID]*inflightPunch
+
+	tracer   Tracer
+	punchers *puncherRegistry
+}
+
+// Option configures a HolePunchService constructed by NewHolePunchService.
+type Option func(*HolePunchService) error
+
+// WithTracer sets a Tracer that observes the lifecycle of every hole punch
+// attempt. The default is a no-op Tracer.
+func WithTracer(tr Tracer) Option {
+	return func(hs *HolePunchService) error {
+		hs.tracer = tr
+		return nil
+	}
+}
+
+// NewHolePunchService creates a new service that can be used to make direct
+// connections with a peer via hole punching. The `active` flag controls
+// whether this host will initiate hole punches, or only respond to them.
+//
+// ctx is the service-level context: the responder side's stream handler
+// derives its own per-stream deadline from it, and cancelling it (or calling
+// Close) tears down every in-flight handler goroutine.
+func NewHolePunchService(ctx context.Context, h host.Host, ids *identify.IDService, active bool, opts ...Option) (*HolePunchService, error) {
+	if ids == nil {
+		return nil, fmt.Errorf("identify service can't be nil")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	hs := &HolePunchService{
+		ctx:      ctx,
+		cancel:   cancel,
+		h:        h,
+		ids:      ids,
+		active:   active,
+		inflight: make(map[peer.ID]*inflightPunch),
+		tracer:   noopTracer{},
+		punchers: newPuncherRegistry(),
+	}
+	for _, opt := range opts {
+		if err := opt(hs); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	h.SetStreamHandler(Protocol, hs.handleNewStreamAsync)
+	return hs, nil
+}
+
+// Close tears down the service: every in-flight responder goroutine is
+// cancelled, and Close blocks until they have all exited.
+func (hs *HolePunchService) Close() error {
+	hs.h.RemoveStreamHandler(Protocol)
+	hs.cancel()
+	hs.wg.Wait()
+	return nil
+}
+
+// HandlerErrors returns the errors encountered by the stream handler for the
+// DCUtR protocol since the service started. It exists mostly for testing.
+func (hs *HolePunchService) HandlerErrors() []error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	cpy := make([]error, len(hs.handlerErrors))
+	copy(cpy, hs.handlerErrors)
+	return cpy
+}
+
+func (hs *HolePunchService) addHandlerError(err error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.handlerErrors = append(hs.handlerErrors, err)
+}
+
+// hasDirectConn returns true if we already have a non-relayed connection to
+// the given peer.
+func (hs *HolePunchService) hasDirectConn(p peer.ID) bool {
+	for _, c := range hs.h.Network().ConnsToPeer(p) {
+		if !isRelayAddr(c.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRelayAddr(a ma.Multiaddr) bool {
+	_, err := a.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// directDial attempts a plain connection to rp's known non-relay addresses,
+// without going through the CONNECT/SYNC exchange at all. It's used as a
+// fallback when rp doesn't speak this protocol, in case it's simply
+// directly dialable and doesn't need hole punching.
+func (hs *HolePunchService) directDial(ctx context.Context, rp peer.ID) error {
+	addrs := nonRelayAddrs(hs.h.Peerstore().Addrs(rp))
+	if len(addrs) == 0 {
+		return fmt.Errorf("no direct addresses known for %s", rp)
+	}
+
+	start := time.Now()
+	if err := hs.h.Connect(ctx, peer.AddrInfo{ID: rp, Addrs: addrs}); err != nil {
+		hs.tracer.DirectDialFailed(rp, time.Since(start), err)
+		return err
+	}
+	hs.tracer.DirectDialSuccessful(rp, time.Since(start))
+	return nil
+}
+
+func nonRelayAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	out := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if !isRelayAddr(a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// HolePunch attempts to establish a direct connection with the given peer,
+// coordinated through a relayed connection, by exchanging observed
+// addresses and then dialing back in parallel, punching a hole through
+// both sides' NATs in the process. If we already have a direct (non-relay)
+// connection to rp, it returns immediately without doing any of that. If
+// rp doesn't speak this protocol, a plain direct dial to its known
+// addresses is tried instead, in case it's simply publicly reachable. If a
+// hole punch to this peer is already in flight (either because we
+// initiated one concurrently, or because the remote peer's rendezvous
+// raced with ours), it waits for that attempt to complete instead of
+// starting a second one.
+//
+// ctx bounds the whole exchange: the CONNECT/SYNC roundtrip, and the
+// subsequent dial-back. Cancelling it aborts any outstanding read, write, or
+// dial started on its behalf.
+func (hs *HolePunchService) HolePunch(ctx context.Context, rp peer.ID) error {
+	if hs.hasDirectConn(rp) {
+		return nil
+	}
+
+	ip, isNew := hs.joinOrWait(rp, roleInitiator, newNonce())
+	if !isNew {
+		select {
+		case <-ip.done:
+			return ip.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	err := hs.initiate(ctx, rp, ip)
+	if err == errYielded {
+		// a concurrent, lower-nonce rendezvous from rp won the race and
+		// took over this same entry to finish the punch as a responder;
+		// wait for its real result instead of reporting our own yield.
+		<-ip.done
+		return ip.err
+	}
+	hs.finish(rp, ip, err)
+	return err
+}
+
+// joinOrWait registers an in-flight punch for rp with the given role/nonce
+// if none exists yet, returning (the new entry, true). If one already
+// exists, it is returned unmodified along with false, and the caller is
+// expected to wait on its done channel rather than start its own attempt.
+func (hs *HolePunchService) joinOrWait(rp peer.ID, r role, nonce uint64) (*inflightPunch, bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	if ip, ok := hs.inflight[rp]; ok {
+		return ip, false
+	}
+
+	ip := &inflightPunch{role: r, nonce: nonce, done: make(chan struct{}), abort: make(chan struct{})}
+	hs.inflight[rp] = ip
+	return ip, true
+}
+
+// finish is idempotent: the yielding initiator's HolePunch call and the
+// takeover responder in handleNewStream can both end up calling finish on
+// the same entry (the initiator's read unblocks with a protocol-level
+// error, rather than observing ip.abort, once the takeover side closes the
+// stream without answering), and closing ip.done twice would panic.
+func (hs *HolePunchService) finish(rp peer.ID, ip *inflightPunch, err error) {
+	ip.finishOnce.Do(func() {
+		hs.mu.Lock()
+		ip.err = err
+		if hs.inflight[rp] == ip {
+			delete(hs.inflight, rp)
+		}
+		hs.mu.Unlock()
+		close(ip.done)
+	})
+}
+
+// yielded reports whether a concurrent, lower-nonce rendezvous from the
+// remote peer has already taken over this entry, without blocking.
+func (ip *inflightPunch) yielded() bool {
+	select {
+	case <-ip.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+func newNonce() uint64 {
+	return rand.Uint64()
+}
+
+// winsRendezvous decides, from the local side, whether the local rendezvous
+// attempt (localNonce) beats a concurrent one from the remote peer
+// (remoteNonce) when both sides raced to hole punch each other at once. The
+// lower nonce wins; ties (which a 64-bit random nonce makes exceedingly
+// unlikely, but not impossible) are broken by comparing peer IDs so that
+// exactly one side ever concludes it won, never both or neither.
+func winsRendezvous(localNonce uint64, localID peer.ID, remoteNonce uint64, remoteID peer.ID) bool {
+	if localNonce != remoteNonce {
+		return localNonce < remoteNonce
+	}
+	return localID < remoteID
+}
+
+// watchCtx resets s as soon as ctx is done, so that blocking reads/writes on
+// s are unblocked by context cancellation. The returned func must be called
+// once the caller is done with s, to stop the watcher goroutine.
+func watchCtx(ctx context.Context, s network.Stream) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Reset()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// initiate drives the initiator side of the CONNECT/SYNC exchange on a
+// freshly opened stream to rp, then dials back the addresses the remote
+// reported. It bails out early if ip.abort is closed, which happens when a
+// concurrent, lower-nonce rendezvous from rp wins the race and we need to
+// yield the initiator role to it.
+func (hs *HolePunchService) initiate(ctx context.Context, rp peer.ID, ip *inflightPunch) error {
+	s, err := hs.h.NewStream(ctx, rp, Protocol)
+	if err != nil {
+		if hs.hasDirectConn(rp) {
+			// opening the DCUtR stream failed (rp doesn't speak this
+			// protocol, or multistream-select failed for some other
+			// reason), but NewStream's own implicit dial succeeded: we
+			// ended up directly connected anyway, so there's nothing left
+			// to punch.
+			return nil
+		}
+		// the implicit dial failed too; rp may still be opportunistically
+		// dialable over a different address than the one NewStream just
+		// tried, without any NAT traversal needed.
+		if derr := hs.directDial(ctx, rp); derr == nil {
+			return nil
+		}
+		return fmt.Errorf("error opening hole punching stream: %w", err)
+	}
+	defer s.Close()
+
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	}
+	stop := watchCtx(ctx, s)
+	defer stop()
+
+	w := protoio.NewDelimitedWriter(s)
+	rd := protoio.NewDelimitedReader(s, network.MessageSizeMax)
+
+	// send a CONNECT and read back the response CONNECT with the remote's
+	// observed addresses, so we can measure the RTT of the relayed stream.
+	start := time.Now()
+	nonce := ip.nonce
+	if err := w.WriteMsg(&holepunch_pb.HolePunch{
+		Type:     holepunch_pb.HolePunch_CONNECT.Enum(),
+		ObsAddrs: addrsToBytes(hs.ids.OwnObservedAddrs()),
+		Nonce:    &nonce,
+	}); err != nil {
+		if ip.yielded() {
+			return errYielded
+		}
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+
+	var msg holepunch_pb.HolePunch
+	if err := rd.ReadMsg(&msg); err != nil {
+		// a concurrent, lower-nonce rendezvous from rp can win the race and
+		// take over our own stream handler for rp, which answers by
+		// closing its (our) incoming stream without ever sending a CONNECT
+		// back on this one; that surfaces here as a plain read error
+		// indistinguishable from a protocol failure unless we also check
+		// whether we've been yielded in the meantime.
+		if ip.yielded() {
+			return errYielded
+		}
+		if isDeadlineErr(err) || ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("i/o deadline reached: %w", err)
+		} else if err == io.EOF {
+			err = fmt.Errorf("i/o deadline reached: %w", err)
+		} else {
+			err = fmt.Errorf("failed to read HolePunch_CONNECT message: %w", err)
+		}
+		hs.tracer.ProtocolError(rp, err)
+		return err
+	}
+	if msg.GetType() != holepunch_pb.HolePunch_CONNECT {
+		err := fmt.Errorf("expected HolePunch_CONNECT message, got %s", msg.GetType())
+		hs.tracer.ProtocolError(rp, err)
+		return err
+	}
+	rtt := time.Since(start)
+
+	remoteAddrs := bytesToAddrs(msg.ObsAddrs)
+
+	if err := w.WriteMsg(&holepunch_pb.HolePunch{Type: holepunch_pb.HolePunch_SYNC.Enum()}); err != nil {
+		return fmt.Errorf("failed to send SYNC: %w", err)
+	}
+
+	// wait out half the round trip time, so that the dial-back on both
+	// sides happens at roughly the same time.
+	timer := time.NewTimer(rtt / 2)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ip.abort:
+		return errYielded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	hs.tracer.StartHolePunch(rp, remoteAddrs, rtt)
+	dialStart := time.Now()
+	err := hs.dialBack(ctx, rp, remoteAddrs, true)
+	hs.tracer.EndHolePunch(rp, time.Since(dialStart), err)
+	return err
+}
+
+// dialBack dials the given addresses in parallel, one Puncher per address
+// depending on its transport (TCP simultaneous-open, QUIC hole punch, ...),
+// and returns as soon as the first one succeeds, cancelling the rest. All
+// addresses are expected to belong to rp. isInitiator reflects which side
+// of the CONNECT/SYNC rendezvous we played, and is threaded through to each
+// Puncher so it dials as the simultaneous-open client or server accordingly.
+func (hs *HolePunchService) dialBack(ctx context.Context, rp peer.ID, addrs []ma.Multiaddr, isInitiator bool) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("no observed addresses to dial back")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		err error
+	}
+	results := make(chan result, len(addrs))
+
+	var wg sync.WaitGroup
+	attempted := 0
+	for _, a := range addrs {
+		puncher, err := hs.punchers.forAddr(hs.h, rp, a, isInitiator)
+		if err != nil {
+			// no strategy registered for this address's transport; skip it.
+			continue
+		}
+		attempted++
+		hs.tracer.HolePunchAttempt(rp, a)
+
+		wg.Add(1)
+		go func(a ma.Multiaddr, puncher Puncher) {
+			defer wg.Done()
+			_, err := puncher.Punch(ctx, a)
+			results <- result{err: err}
+		}(a, puncher)
+	}
+	if attempted == 0 {
+		return fmt.Errorf("no puncher available for any of %d observed addresses", len(addrs))
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	for r := range results {
+		if r.err == nil {
+			cancel() // a direct connection exists now; abort the other dial-backs.
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return fmt.Errorf("all dial-back attempts failed: %w", firstErr)
+}
+
+// handleNewStreamAsync spawns the actual handler in its own goroutine,
+// tracked in hs.wg so Close can wait for it to exit.
+func (hs *HolePunchService) handleNewStreamAsync(s network.Stream) {
+	hs.wg.Add(1)
+	go func() {
+		defer hs.wg.Done()
+		hs.handleNewStream(s)
+	}()
+}
+
+// handleNewStream is the response-side stream handler for the DCUtR
+// protocol. If we also have a hole punch to rp in flight as an initiator
+// (i.e. both sides rendezvoused with each other at roughly the same time),
+// the nonce carried in the incoming CONNECT message decides which side
+// keeps the initiator role: whichever side holds the lower nonce stays the
+// initiator, and the other yields and finishes the punch as a responder on
+// this stream instead, so we never end up with two crossing SYNC volleys.
+func (hs *HolePunchService) handleNewStream(s network.Stream) {
+	rp := s.Conn().RemotePeer()
+
+	ctx, cancel := context.WithTimeout(hs.ctx, defaultHandlerTimeout)
+	defer cancel()
+	if dl, ok := ctx.Deadline(); ok {
+		s.SetDeadline(dl)
+	}
+	stop := watchCtx(ctx, s)
+	defer stop()
+
+	rd := protoio.NewDelimitedReader(s, network.MessageSizeMax)
+	w := protoio.NewDelimitedWriter(s)
+
+	var msg holepunch_pb.HolePunch
+	if err := rd.ReadMsg(&msg); err != nil {
+		s.Reset()
+		if isDeadlineErr(err) || ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("i/o deadline reached: %w", err)
+		} else {
+			err = fmt.Errorf("failed to read HolePunch_CONNECT message: %w", err)
+		}
+		hs.addHandlerError(err)
+		hs.tracer.ProtocolError(rp, err)
+		return
+	}
+	if msg.GetType() != holepunch_pb.HolePunch_CONNECT {
+		s.Reset()
+		err := fmt.Errorf("expected HolePunch_CONNECT message, got %s", msg.GetType())
+		hs.addHandlerError(err)
+		hs.tracer.ProtocolError(rp, err)
+		return
+	}
+	remoteAddrs := bytesToAddrs(msg.ObsAddrs)
+	remoteNonce := msg.GetNonce()
+
+	ip, isNew := hs.joinOrWait(rp, roleResponder, 0)
+	if !isNew {
+		// Read ip.role and, if we're taking over, flip it to roleResponder
+		// in the same critical section: rp can open two concurrent DCUtR
+		// streams while we have an outgoing attempt in flight for it (a
+		// retry, a duplicate connection, or just a racing/buggy peer), and
+		// both handler goroutines evaluate winsRendezvous identically. If
+		// both read a stale roleInitiator and both decided "the remote
+		// wins", both would call close(ip.abort) and the second would
+		// panic. Setting ip.role before unlocking means the second
+		// goroutine sees roleResponder already and takes the "already in
+		// progress" branch instead, so the close happens exactly once.
+		hs.mu.Lock()
+		switch {
+		case ip.role == roleResponder:
+			hs.mu.Unlock()
+			// another stream from the same peer is already being serviced.
+			s.Reset()
+			hs.addHandlerError(fmt.Errorf("hole punch with %s already in progress", rp))
+			return
+		case winsRendezvous(ip.nonce, hs.h.ID(), remoteNonce, rp):
+			hs.mu.Unlock()
+			// our own outgoing attempt wins the rendezvous race: let it
+			// drive, we just park this stream. ip.done only closes once
+			// that racing initiate() call returns, and it's bounded by
+			// whatever context its own HolePunch(ctx, rp) caller passed
+			// in, not hs.ctx - so this also watches ctx (derived from
+			// hs.ctx) to make sure Close() can't be left blocked on a
+			// handler parked here waiting on someone else's context.
+			s.Close()
+			select {
+			case <-ip.done:
+			case <-ctx.Done():
+			}
+			return
+		default:
+			// the remote's attempt wins: abort our own initiator attempt
+			// and take over its in-flight entry to finish this punch as a
+			// responder, so whoever is waiting on it observes our result
+			// instead of a synthetic yield error.
+			ip.role = roleResponder
+			hs.mu.Unlock()
+			close(ip.abort)
+		}
+	}
+
+	if err := w.WriteMsg(&holepunch_pb.HolePunch{
+		Type:     holepunch_pb.HolePunch_CONNECT.Enum(),
+		ObsAddrs: addrsToBytes(hs.ids.OwnObservedAddrs()),
+	}); err != nil {
+		s.Reset()
+		err = fmt.Errorf("failed to send CONNECT: %w", err)
+		hs.addHandlerError(err)
+		hs.tracer.ProtocolError(rp, err)
+		hs.finish(rp, ip, err)
+		return
+	}
+
+	msg.Reset()
+	if err := rd.ReadMsg(&msg); err != nil {
+		s.Reset()
+		if isDeadlineErr(err) || ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("i/o deadline reached: %w", err)
+		} else {
+			err = fmt.Errorf("expected HolePunch_SYNC message: %w", err)
+		}
+		hs.addHandlerError(err)
+		hs.tracer.ProtocolError(rp, err)
+		hs.finish(rp, ip, err)
+		return
+	}
+	if msg.GetType() != holepunch_pb.HolePunch_SYNC {
+		s.Reset()
+		err := fmt.Errorf("expected HolePunch_SYNC message, got %s", msg.GetType())
+		hs.addHandlerError(err)
+		hs.tracer.ProtocolError(rp, err)
+		hs.finish(rp, ip, err)
+		return
+	}
+	s.Close()
+
+	dialStart := time.Now()
+	err := hs.dialBack(ctx, rp, remoteAddrs, false)
+	hs.tracer.EndHolePunch(rp, time.Since(dialStart), err)
+	hs.finish(rp, ip, err)
+	if err != nil {
+		hs.addHandlerError(err)
+	}
+}
+
+func addrsToBytes(as []ma.Multiaddr) [][]byte {
+	bzs := make([][]byte, 0, len(as))
+	for _, a := range as {
+		bzs = append(bzs, a.Bytes())
+	}
+	return bzs
+}
+
+func bytesToAddrs(bzs [][]byte) []ma.Multiaddr {
+	addrs := make([]ma.Multiaddr, 0, len(bzs))
+	for _, b := range bzs {
+		a, err := ma.NewMultiaddrBytes(b)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+func isDeadlineErr(err error) bool {
+	type timeout interface {
+		Timeout() bool
+	}
+	t, ok := err.(timeout)
+	return ok && t.Timeout()
+}
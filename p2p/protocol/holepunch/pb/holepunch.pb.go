@@ -0,0 +1,90 @@
+// Code generated by protoc-gen-gogo. DO NOT EDIT.
+// source: holepunch.proto
+
+package holepunch_pb
+
+import (
+	fmt "fmt"
+	proto "github.com/gogo/protobuf/proto"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type HolePunch_Type int32
+
+const (
+	HolePunch_CONNECT HolePunch_Type = 100
+	HolePunch_SYNC    HolePunch_Type = 300
+)
+
+var HolePunch_Type_name = map[int32]string{
+	100: "CONNECT",
+	300: "SYNC",
+}
+
+var HolePunch_Type_value = map[string]int32{
+	"CONNECT": 100,
+	"SYNC":    300,
+}
+
+func (x HolePunch_Type) Enum() *HolePunch_Type {
+	p := new(HolePunch_Type)
+	*p = x
+	return p
+}
+
+func (x HolePunch_Type) String() string {
+	return proto.EnumName(HolePunch_Type_name, int32(x))
+}
+
+func (x *HolePunch_Type) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(HolePunch_Type_value, data, "HolePunch_Type")
+	if err != nil {
+		return err
+	}
+	*x = HolePunch_Type(value)
+	return nil
+}
+
+type HolePunch struct {
+	Type                 *HolePunch_Type `protobuf:"varint,1,req,name=type,enum=holepunch.pb.HolePunch_Type" json:"type,omitempty"`
+	ObsAddrs             [][]byte        `protobuf:"bytes,2,rep,name=ObsAddrs" json:"ObsAddrs,omitempty"`
+	Nonce                *uint64         `protobuf:"varint,3,opt,name=Nonce" json:"Nonce,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
+}
+
+func (m *HolePunch) Reset()         { *m = HolePunch{} }
+func (m *HolePunch) String() string { return proto.CompactTextString(m) }
+func (*HolePunch) ProtoMessage()    {}
+
+func (m *HolePunch) GetType() HolePunch_Type {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return HolePunch_CONNECT
+}
+
+func (m *HolePunch) GetObsAddrs() [][]byte {
+	if m != nil {
+		return m.ObsAddrs
+	}
+	return nil
+}
+
+func (m *HolePunch) GetNonce() uint64 {
+	if m != nil && m.Nonce != nil {
+		return *m.Nonce
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterEnum("holepunch.pb.HolePunch_Type", HolePunch_Type_name, HolePunch_Type_value)
+	proto.RegisterType((*HolePunch)(nil), "holepunch.pb.HolePunch")
+}
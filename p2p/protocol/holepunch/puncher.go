@@ -0,0 +1,224 @@
+package holepunch
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Puncher drives the dial-back for a single candidate address, using
+// whatever technique its transport needs to punch through a NAT: a
+// TCP simultaneous open, a QUIC hole punch, and so on. It is bound to one
+// remote peer and is used for exactly one dial-back attempt.
+type Puncher interface {
+	Punch(ctx context.Context, addr ma.Multiaddr) (network.Conn, error)
+}
+
+// PuncherFactory builds a Puncher for dialing rp through h. It is looked up
+// by the multiaddr protocol (e.g. ma.P_TCP, ma.P_QUIC) of the candidate
+// address being dialed. isInitiator tells the Puncher which side of the
+// simultaneous-open it's playing: the hole punch initiator always dials as
+// the client, the responder always as the server.
+type PuncherFactory func(h host.Host, rp peer.ID, isInitiator bool) Puncher
+
+// puncherRegistry maps multiaddr protocols to the PuncherFactory that knows
+// how to hole punch that transport. It exists so that new transports (e.g.
+// WebRTC) can register their own strategy without HolePunchService needing
+// to know about them.
+type puncherRegistry struct {
+	mu      sync.RWMutex
+	byProto map[int]PuncherFactory
+}
+
+func newPuncherRegistry() *puncherRegistry {
+	r := &puncherRegistry{byProto: make(map[int]PuncherFactory)}
+	r.register(ma.P_QUIC, func(h host.Host, rp peer.ID, isInitiator bool) Puncher {
+		return &quicPuncher{h: h, rp: rp, isInitiator: isInitiator}
+	})
+	r.register(ma.P_TCP, func(h host.Host, rp peer.ID, isInitiator bool) Puncher {
+		return &tcpPuncher{h: h, rp: rp, isInitiator: isInitiator}
+	})
+	return r
+}
+
+func (r *puncherRegistry) register(proto int, f PuncherFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byProto[proto] = f
+}
+
+// forAddr returns a Puncher for the given address, picked by the first of
+// its protocols that has a registered factory.
+func (r *puncherRegistry) forAddr(h host.Host, rp peer.ID, addr ma.Multiaddr, isInitiator bool) (Puncher, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, p := range addr.Protocols() {
+		if f, ok := r.byProto[p.Code]; ok {
+			return f(h, rp, isInitiator), nil
+		}
+	}
+	return nil, fmt.Errorf("no puncher registered for address %s", addr)
+}
+
+// WithPuncher registers a Puncher factory for the given multiaddr protocol
+// (e.g. ma.P_WEBRTC), overriding the default TCP and QUIC strategies if they
+// collide. It lets callers plug in hole punching support for transports
+// this package doesn't know about.
+func WithPuncher(proto int, f PuncherFactory) Option {
+	return func(hs *HolePunchService) error {
+		hs.punchers.register(proto, f)
+		return nil
+	}
+}
+
+// tcpPuncher dials addr using the host's regular dialer under a
+// simultaneous-connect context, relying on the TCP stack's simultaneous
+// open to get through both sides' NATs.
+type tcpPuncher struct {
+	h           host.Host
+	rp          peer.ID
+	isInitiator bool
+}
+
+func (p *tcpPuncher) Punch(ctx context.Context, addr ma.Multiaddr) (network.Conn, error) {
+	ctx = network.WithSimultaneousConnect(ctx, p.isInitiator, "hole-punching")
+	p.h.Peerstore().AddAddr(p.rp, addr, time.Minute)
+	if err := p.h.Connect(ctx, peer.AddrInfo{ID: p.rp, Addrs: []ma.Multiaddr{addr}}); err != nil {
+		return nil, err
+	}
+	return connToAddr(p.h, p.rp, addr)
+}
+
+// natPacketBurstSize is the number of best-effort UDP packets a quicPuncher
+// fires at the remote address before attempting the QUIC dial, to open up
+// the local NAT's mapping the way the TCP handshake's SYN does for free.
+const natPacketBurstSize = 5
+
+// quicPuncher performs a short burst of throwaway UDP packets at addr to
+// open a NAT mapping, mirroring the other side's burst, and then dials the
+// real QUIC connection under a simultaneous-connect context.
+type quicPuncher struct {
+	h           host.Host
+	rp          peer.ID
+	isInitiator bool
+}
+
+func (p *quicPuncher) Punch(ctx context.Context, addr ma.Multiaddr) (network.Conn, error) {
+	netw, _, err := manet.DialArgs(addr)
+	if err != nil {
+		return nil, err
+	}
+	localAddr, err := localQUICAddr(p.h, netw)
+	if err != nil {
+		return nil, fmt.Errorf("resolving local QUIC listener for NAT_PACKET burst: %w", err)
+	}
+	if err := sendNATPacketBurst(ctx, localAddr, addr); err != nil {
+		return nil, fmt.Errorf("NAT_PACKET burst to %s failed: %w", addr, err)
+	}
+
+	ctx = network.WithSimultaneousConnect(ctx, p.isInitiator, "hole-punching")
+	p.h.Peerstore().AddAddr(p.rp, addr, time.Minute)
+	if err := p.h.Connect(ctx, peer.AddrInfo{ID: p.rp, Addrs: []ma.Multiaddr{addr}}); err != nil {
+		return nil, err
+	}
+	return connToAddr(p.h, p.rp, addr)
+}
+
+// localQUICAddr returns the local address (as a "host:port" or ":port"
+// string suitable for net.ListenConfig.ListenPacket) that h's QUIC
+// transport is already listening on for the given network family ("udp4"
+// or "udp6"). The NAT_PACKET burst must be sent from this exact local
+// port: go-libp2p's QUIC transport dials out through the very same
+// SO_REUSEPORT-shared socket it listens on, so a burst fired from any
+// other port opens a NAT mapping the real dial never uses.
+func localQUICAddr(h host.Host, netw string) (string, error) {
+	wantV6 := netw == "udp6"
+	for _, a := range h.Network().ListenAddresses() {
+		if _, err := a.ValueForProtocol(ma.P_QUIC); err != nil {
+			continue
+		}
+		_, isV6 := a.ValueForProtocol(ma.P_IP6)
+		if (isV6 == nil) != wantV6 {
+			continue
+		}
+		port, err := a.ValueForProtocol(ma.P_UDP)
+		if err != nil {
+			continue
+		}
+		return ":" + port, nil
+	}
+	return "", fmt.Errorf("%s has no QUIC listener for %s", h.ID(), netw)
+}
+
+// sendNATPacketBurst fires a handful of empty UDP datagrams at addr from
+// localAddr. Their content is irrelevant and the remote end is expected to
+// drop them; the only purpose is to make the local NAT create (or refresh)
+// a mapping for addr, under the local port the real QUIC dial that follows
+// will also use, before the QUIC handshake tries to use that mapping.
+// localAddr is bound with SO_REUSEADDR/SO_REUSEPORT so it can share that
+// port with the host's own QUIC listener instead of colliding with it.
+func sendNATPacketBurst(ctx context.Context, localAddr string, addr ma.Multiaddr) error {
+	netw, rhost, err := manet.DialArgs(addr)
+	if err != nil {
+		return err
+	}
+	if netw != "udp4" && netw != "udp6" {
+		return fmt.Errorf("%s is not a UDP address", addr)
+	}
+
+	raddr, err := net.ResolveUDPAddr(netw, rhost)
+	if err != nil {
+		return err
+	}
+
+	lc := net.ListenConfig{Control: controlReusePort}
+	conn, err := lc.ListenPacket(ctx, netw, localAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	pkt := []byte("libp2p-holepunch-nat-packet")
+	for i := 0; i < natPacketBurstSize; i++ {
+		if _, err := conn.WriteTo(pkt, raddr); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// connToAddr returns the connection to rp that was just dialed over addr.
+// It prefers an exact remote-multiaddr match, but falls back to any
+// existing non-relay connection to rp: Connect is a no-op when one already
+// exists, so a candidate address that doesn't resolve to a fresh dial (for
+// instance a stale or unreachable observed address, with the peers already
+// connected directly some other way) still counts as the punch succeeding.
+func connToAddr(h host.Host, rp peer.ID, addr ma.Multiaddr) (network.Conn, error) {
+	var direct network.Conn
+	for _, c := range h.Network().ConnsToPeer(rp) {
+		if c.RemoteMultiaddr().Equal(addr) {
+			return c, nil
+		}
+		if direct == nil && !isRelayAddr(c.RemoteMultiaddr()) {
+			direct = c
+		}
+	}
+	if direct != nil {
+		return direct, nil
+	}
+	return nil, fmt.Errorf("connected to %s but found no connection over %s", rp, addr)
+}
@@ -0,0 +1,177 @@
+package holepunch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePuncher is a Puncher whose outcome is fixed at construction time, used
+// to exercise HolePunchService.dialBack's races between transports without
+// standing up real hosts or a simulated NAT.
+type fakePuncher struct {
+	conn network.Conn
+	err  error
+}
+
+func (f *fakePuncher) Punch(ctx context.Context, addr ma.Multiaddr) (network.Conn, error) {
+	return f.conn, f.err
+}
+
+func TestDialBackPicksQUICWhenTCPFails(t *testing.T) {
+	hs := &HolePunchService{tracer: noopTracer{}, punchers: newPuncherRegistry()}
+	hs.punchers.register(ma.P_TCP, func(h host.Host, rp peer.ID, isInitiator bool) Puncher {
+		return &fakePuncher{err: errors.New("simulated NAT: TCP simultaneous-open failed")}
+	})
+	hs.punchers.register(ma.P_QUIC, func(h host.Host, rp peer.ID, isInitiator bool) Puncher {
+		return &fakePuncher{}
+	})
+
+	addrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/4001"),
+		ma.StringCast("/ip4/1.2.3.4/udp/4001/quic"),
+	}
+
+	err := hs.dialBack(context.Background(), peer.ID("remote"), addrs, true)
+	require.NoError(t, err)
+}
+
+// natPacketOnlyPuncher drives the real NAT_PACKET burst quicPuncher uses
+// against addr, then reports success without attempting an actual QUIC
+// dial: this tree has no QUIC transport wired in for HolePunchService to
+// dial over, so this stands in for the handshake a real quicPuncher would
+// attempt once the burst has opened the NAT mapping.
+type natPacketOnlyPuncher struct{}
+
+func (natPacketOnlyPuncher) Punch(ctx context.Context, addr ma.Multiaddr) (network.Conn, error) {
+	if err := sendNATPacketBurst(ctx, ":0", addr); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// TestDialBackPicksQUICUnderSimulatedNAT exercises the real NAT_PACKET
+// burst over a real UDP socket standing in for a QUIC listener behind a
+// simulated NAT, rather than stubbing Punch's result outright as
+// TestDialBackPicksQUICWhenTCPFails does. This tree has no QUIC transport
+// wired in, so the TCP side is still a simulated failure rather than a
+// real blocked dial; the part under test is the burst and the selection
+// between the two Punchers, not the TCP transport itself.
+func TestDialBackPicksQUICUnderSimulatedNAT(t *testing.T) {
+	tcpAddr := ma.StringCast("/ip4/127.0.0.1/tcp/1")
+
+	// simulate the peer behind the NAT accepting UDP once a local mapping
+	// has been carved by an outbound packet, by standing up a real UDP
+	// listener and having it "answer" only once it has observed the whole
+	// NAT_PACKET burst.
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer udpConn.Close()
+	quicAddr, err := manet.FromNetAddr(udpConn.LocalAddr())
+	require.NoError(t, err)
+
+	burstReceived := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for i := 0; i < natPacketBurstSize; i++ {
+			if _, _, err := udpConn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+		burstReceived <- struct{}{}
+	}()
+
+	hs := &HolePunchService{tracer: noopTracer{}, punchers: newPuncherRegistry()}
+	hs.punchers.register(ma.P_TCP, func(h host.Host, rp peer.ID, isInitiator bool) Puncher {
+		return &fakePuncher{err: errors.New("simulated NAT: TCP simultaneous-open blocked")}
+	})
+	hs.punchers.register(ma.P_QUIC, func(h host.Host, rp peer.ID, isInitiator bool) Puncher {
+		return natPacketOnlyPuncher{}
+	})
+
+	err = hs.dialBack(context.Background(), peer.ID("remote"), []ma.Multiaddr{tcpAddr, quicAddr}, true)
+	require.NoError(t, err)
+
+	select {
+	case <-burstReceived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("NAT_PACKET burst never reached the simulated QUIC listener")
+	}
+}
+
+// TestNATPacketBurstReusesLocalPortForRealDial exercises the property the
+// fix to sendNATPacketBurst depends on: a burst bound to a given local
+// port must both (a) actually go out from that port, and (b) leave the
+// port free for a second socket to bind via SO_REUSEPORT right afterwards,
+// standing in for go-libp2p's QUIC transport dialing out through its own
+// listening socket once the burst is done. Before the fix, the burst used
+// a throwaway ephemeral port that was closed before the real dial ran, so
+// the NAT mapping it opened belonged to a port the real dial never used.
+// This tree has no QUIC transport wired in, so the "real dial" here is a
+// second ListenPacket on the same port rather than an actual QUIC Initial.
+func TestNATPacketBurstReusesLocalPortForRealDial(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer udpConn.Close()
+	quicAddr, err := manet.FromNetAddr(udpConn.LocalAddr())
+	require.NoError(t, err)
+
+	// the simulated NAT's mapping is keyed on the source port of the first
+	// burst packet, the way a real NAT's mapping is keyed on the local
+	// port a packet came from.
+	mappedPort := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		n, raddr, err := udpConn.ReadFrom(buf)
+		if err != nil || n == 0 {
+			return
+		}
+		mappedPort <- raddr.(*net.UDPAddr).Port
+	}()
+
+	// grab a free local port the way the host's QUIC listener would
+	// already hold one, then release it so the burst below can bind to it.
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	localPort := probe.LocalAddr().(*net.UDPAddr).Port
+	require.NoError(t, probe.Close())
+	localAddr := fmt.Sprintf(":%d", localPort)
+
+	require.NoError(t, sendNATPacketBurst(context.Background(), localAddr, quicAddr))
+
+	select {
+	case p := <-mappedPort:
+		require.Equal(t, localPort, p, "burst must go out from the local port the real dial will reuse")
+	case <-time.After(2 * time.Second):
+		t.Fatal("NAT_PACKET burst never reached the simulated NAT listener")
+	}
+
+	// the real dial reuses that same local port via SO_REUSEPORT, the way
+	// go-libp2p's QUIC transport dials out through its own listening
+	// socket; if the burst had left the port unavailable (or used a
+	// different one), this bind would fail or be pointless.
+	lc := net.ListenConfig{Control: controlReusePort}
+	dialConn, err := lc.ListenPacket(context.Background(), "udp4", localAddr)
+	require.NoError(t, err, "real dial must be able to reuse the exact port the burst just used")
+	defer dialConn.Close()
+	require.Equal(t, localPort, dialConn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestDialBackFailsWhenNoPuncherMatches(t *testing.T) {
+	hs := &HolePunchService{tracer: noopTracer{}, punchers: newPuncherRegistry()}
+
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/udp/4001")}
+
+	err := hs.dialBack(context.Background(), peer.ID("remote"), addrs, true)
+	require.Error(t, err)
+}
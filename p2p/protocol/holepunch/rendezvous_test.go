@@ -0,0 +1,22 @@
+package holepunch
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWinsRendezvousBreaksNonceTiesByPeerID(t *testing.T) {
+	a, b := peer.ID("peer-a"), peer.ID("peer-b")
+
+	// distinct nonces: the lower one wins outright, regardless of IDs.
+	require.True(t, winsRendezvous(1, a, 2, b))
+	require.False(t, winsRendezvous(2, a, 1, b))
+
+	// tied nonces used to make both sides think they'd won (ip.nonce <=
+	// remoteNonce is true on both ends when they're equal); the tie must
+	// now be broken by peer ID so exactly one side wins.
+	require.True(t, winsRendezvous(7, a, 7, b))
+	require.False(t, winsRendezvous(7, b, 7, a))
+}
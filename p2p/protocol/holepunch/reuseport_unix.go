@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package holepunch
+
+import "syscall"
+
+// controlReusePort sets SO_REUSEADDR and SO_REUSEPORT on a UDP socket
+// before it's bound, via net.ListenConfig.Control, so the NAT_PACKET burst
+// can bind to the same local port as another live socket (the host's own
+// QUIC listener) instead of failing with "address already in use".
+func controlReusePort(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		if opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); opErr != nil {
+			return
+		}
+		opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package holepunch
+
+import "syscall"
+
+// controlReusePort sets SO_REUSEADDR on a UDP socket before it's bound, via
+// net.ListenConfig.Control, so the NAT_PACKET burst can bind to the same
+// local port as another live socket (the host's own QUIC listener) instead
+// of failing with "address already in use". Windows has no SO_REUSEPORT;
+// SO_REUSEADDR is the closest equivalent it offers for sharing a UDP port.
+func controlReusePort(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
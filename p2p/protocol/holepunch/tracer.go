@@ -0,0 +1,146 @@
+package holepunch
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Tracer is implemented by types that want to observe the lifecycle of hole
+// punch attempts, both as an initiator and as a responder. All methods may
+// be called concurrently, and implementations must be safe for that.
+type Tracer interface {
+	// StartHolePunch is called once the CONNECT/SYNC handshake with remote
+	// has completed and the dial-back round is about to begin, with the
+	// addresses that will be dialed and the RTT measured over the relayed
+	// stream.
+	StartHolePunch(remote peer.ID, addrs []ma.Multiaddr, rtt time.Duration)
+	// EndHolePunch is called once the dial-back round for remote has
+	// finished, successfully or not.
+	EndHolePunch(remote peer.ID, dur time.Duration, err error)
+	// HolePunchAttempt is called right before dialing a single candidate
+	// address as part of a dial-back round.
+	HolePunchAttempt(remote peer.ID, addr ma.Multiaddr)
+	// ProtocolError is called whenever the CONNECT/SYNC exchange with
+	// remote fails at the protocol level, on either the initiator or the
+	// responder side.
+	ProtocolError(remote peer.ID, err error)
+	// DirectDialSuccessful is called when a direct connection to remote was
+	// established without needing to go through the CONNECT/SYNC exchange
+	// at all, because one of remote's known addresses was already dialable.
+	DirectDialSuccessful(remote peer.ID, dur time.Duration)
+	// DirectDialFailed is called when such an opportunistic direct dial was
+	// attempted and failed.
+	DirectDialFailed(remote peer.ID, dur time.Duration, err error)
+}
+
+// noopTracer is the default Tracer, used when NewHolePunchService is not
+// given a WithTracer option.
+type noopTracer struct{}
+
+var _ Tracer = noopTracer{}
+
+func (noopTracer) StartHolePunch(peer.ID, []ma.Multiaddr, time.Duration) {}
+func (noopTracer) EndHolePunch(peer.ID, time.Duration, error)            {}
+func (noopTracer) HolePunchAttempt(peer.ID, ma.Multiaddr)                {}
+func (noopTracer) ProtocolError(peer.ID, error)                          {}
+func (noopTracer) DirectDialSuccessful(peer.ID, time.Duration)           {}
+func (noopTracer) DirectDialFailed(peer.ID, time.Duration, error)        {}
+
+// jsonTracerEvent is the wire format written by JSONTracer, one per line.
+type jsonTracerEvent struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote,omitempty"`
+	Addrs  []string  `json:"addrs,omitempty"`
+	Addr   string    `json:"addr,omitempty"`
+	RTT    string    `json:"rtt,omitempty"`
+	Dur    string    `json:"duration,omitempty"`
+	Err    string    `json:"error,omitempty"`
+}
+
+// JSONTracer is a Tracer that appends one JSON object per line to a file,
+// for offline analysis of hole punching behavior.
+type JSONTracer struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+var _ Tracer = &JSONTracer{}
+
+// NewJSONTracer opens (creating if necessary) the file at path for
+// appending and returns a Tracer that writes events to it.
+func NewJSONTracer(path string) (*JSONTracer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONTracer{w: f}, nil
+}
+
+// Close closes the underlying file.
+func (t *JSONTracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.w.Close()
+}
+
+func (t *JSONTracer) write(evt jsonTracerEvent) {
+	evt.Time = time.Now()
+	b, err := json.Marshal(evt)
+	if err != nil {
+		log.Errorf("failed to marshal hole punch trace event: %s", err)
+		return
+	}
+	b = append(b, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.w.Write(b); err != nil {
+		log.Errorf("failed to write hole punch trace event: %s", err)
+	}
+}
+
+func (t *JSONTracer) StartHolePunch(remote peer.ID, addrs []ma.Multiaddr, rtt time.Duration) {
+	t.write(jsonTracerEvent{Event: "StartHolePunch", Remote: remote.Pretty(), Addrs: addrsToStrings(addrs), RTT: rtt.String()})
+}
+
+func (t *JSONTracer) EndHolePunch(remote peer.ID, dur time.Duration, err error) {
+	t.write(jsonTracerEvent{Event: "EndHolePunch", Remote: remote.Pretty(), Dur: dur.String(), Err: errString(err)})
+}
+
+func (t *JSONTracer) HolePunchAttempt(remote peer.ID, addr ma.Multiaddr) {
+	t.write(jsonTracerEvent{Event: "HolePunchAttempt", Remote: remote.Pretty(), Addr: addr.String()})
+}
+
+func (t *JSONTracer) ProtocolError(remote peer.ID, err error) {
+	t.write(jsonTracerEvent{Event: "ProtocolError", Remote: remote.Pretty(), Err: errString(err)})
+}
+
+func (t *JSONTracer) DirectDialSuccessful(remote peer.ID, dur time.Duration) {
+	t.write(jsonTracerEvent{Event: "DirectDialSuccessful", Remote: remote.Pretty(), Dur: dur.String()})
+}
+
+func (t *JSONTracer) DirectDialFailed(remote peer.ID, dur time.Duration, err error) {
+	t.write(jsonTracerEvent{Event: "DirectDialFailed", Remote: remote.Pretty(), Dur: dur.String(), Err: errString(err)})
+}
+
+func addrsToStrings(addrs []ma.Multiaddr) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,125 @@
+package holepunch_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONTracerWritesOneEventPerLine(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "events.json")
+	tr, err := holepunch.NewJSONTracer(p)
+	require.NoError(t, err)
+
+	remote := peer.ID("test-peer")
+	tr.ProtocolError(remote, errors.New("boom"))
+	tr.DirectDialSuccessful(remote, 42*time.Millisecond)
+	require.NoError(t, tr.Close())
+
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var m map[string]interface{}
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &m))
+		lines = append(lines, m)
+	}
+	require.Len(t, lines, 2)
+	require.Equal(t, "ProtocolError", lines[0]["event"])
+	require.Equal(t, "DirectDialSuccessful", lines[1]["event"])
+}
+
+// recordingTracer is a test-only Tracer that records which hooks fired.
+type recordingTracer struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (rt *recordingTracer) record(name string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.events = append(rt.events, name)
+}
+
+func (rt *recordingTracer) has(name string) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, e := range rt.events {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *recordingTracer) StartHolePunch(peer.ID, []ma.Multiaddr, time.Duration) {
+	rt.record("StartHolePunch")
+}
+func (rt *recordingTracer) EndHolePunch(peer.ID, time.Duration, error) { rt.record("EndHolePunch") }
+func (rt *recordingTracer) HolePunchAttempt(peer.ID, ma.Multiaddr)     { rt.record("HolePunchAttempt") }
+func (rt *recordingTracer) ProtocolError(peer.ID, error)               { rt.record("ProtocolError") }
+func (rt *recordingTracer) DirectDialSuccessful(peer.ID, time.Duration) {
+	rt.record("DirectDialSuccessful")
+}
+func (rt *recordingTracer) DirectDialFailed(peer.ID, time.Duration, error) {
+	rt.record("DirectDialFailed")
+}
+
+func TestTracerObservesDirectDialFallback(t *testing.T) {
+	ctx := context.Background()
+
+	tr := &recordingTracer{}
+	h1, h1ps := mkHostWithHolePunchSvc(t, ctx, holepunch.WithTracer(tr))
+	h2, _ := mkHostWithHolePunchSvc(t, ctx)
+	h2.RemoveStreamHandler(holepunch.Protocol)
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.ConnectedAddrTTL)
+
+	require.NoError(t, h1ps.HolePunch(ctx, h2.ID()))
+
+	// h2 doesn't speak the protocol, so this succeeds via the opportunistic
+	// direct-dial fallback rather than the CONNECT/SYNC dial-back, and only
+	// DirectDialSuccessful fires.
+	require.True(t, tr.has("DirectDialSuccessful"))
+	require.False(t, tr.has("StartHolePunch"))
+	require.False(t, tr.has("HolePunchAttempt"))
+	require.False(t, tr.has("EndHolePunch"))
+}
+
+func TestTracerObservesHolePunchDialBack(t *testing.T) {
+	ctx := context.Background()
+
+	tr := &recordingTracer{}
+	h1, h1ps := mkHostWithHolePunchSvc(t, ctx, holepunch.WithTracer(tr))
+	h2, _ := mkHostWithHolePunchSvc(t, ctx)
+
+	connect(t, ctx, h1, h2)
+	// tear down the direct connection so HolePunch actually goes through the
+	// CONNECT/SYNC exchange and dial-back, rather than short-circuiting on
+	// it: that's the path StartHolePunch, HolePunchAttempt, and EndHolePunch
+	// are meant to observe.
+	for _, c := range h1.Network().ConnsToPeer(h2.ID()) {
+		c.Close()
+	}
+
+	require.NoError(t, h1ps.HolePunch(ctx, h2.ID()))
+
+	require.True(t, tr.has("StartHolePunch"))
+	require.True(t, tr.has("HolePunchAttempt"))
+	require.True(t, tr.has("EndHolePunch"))
+	require.False(t, tr.has("DirectDialFailed"))
+}